@@ -0,0 +1,84 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command decrypt-and-start decrypts KMS-encrypted environment variables and
+// execs a child process with the plaintext values:
+//
+//	decrypt-and-start --kms-key-id alias/my-key --region eu-west-1 -- /app/server --flag
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"emperror.dev/errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+
+	"github.com/bank-vaults/bank-vaults/pkg/kv/awskms"
+	"github.com/bank-vaults/bank-vaults/pkg/kv/decryptstart"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "decrypt-and-start:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	sep := indexOf(args, "--")
+	if sep < 0 {
+		return errors.New("missing '--' separator before the command to exec")
+	}
+
+	fs := flag.NewFlagSet("decrypt-and-start", flag.ContinueOnError)
+	region := fs.String("region", "", "AWS region of the KMS key")
+	kmsID := fs.String("kms-key-id", "", "AWS KMS key ID or ARN used to decrypt")
+	prefixes := fs.String("prefixes", "kms:,decrypt:", "comma-separated env var value prefixes that mark KMS ciphertext")
+	strict := fs.Bool("strict", false, "abort if any prefixed env var fails to decrypt")
+
+	if err := fs.Parse(args[:sep]); err != nil {
+		return err
+	}
+
+	command := args[sep+1:]
+
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion(*region)))
+
+	decrypter, err := awskms.NewRawDecrypter(kms.New(sess), *kmsID, nil)
+	if err != nil {
+		return err
+	}
+
+	opts := decryptstart.Options{
+		Prefixes: strings.Split(*prefixes, ","),
+		Strict:   *strict,
+	}
+
+	return decryptstart.Run(decrypter, command, opts)
+}
+
+func indexOf(args []string, sep string) int {
+	for i, a := range args {
+		if a == sep {
+			return i
+		}
+	}
+
+	return -1
+}
@@ -16,6 +16,7 @@ package awskms
 
 import (
 	"strings"
+	"time"
 
 	"emperror.dev/errors"
 	"github.com/aws/aws-sdk-go/aws"
@@ -38,6 +39,24 @@ type awsKMS struct {
 
 	kmsID             string
 	encryptionContext map[string]*string
+
+	// envelope switches Set to the local envelope-encryption path (see
+	// envelope.go). Get always auto-detects the wire format, so a single
+	// awsKMS value can read ciphertext written by either mode.
+	envelope             bool
+	dekCache             *dekCache
+	maxEncryptionsPerDEK int
+
+	// trustedKeyIDs is the keyring allow-list (see keyring.go), keyed by
+	// canonical key ARN - the form KMS always reports decryption happened
+	// under, regardless of what alias/ID the caller configured. nil means
+	// "trust whatever CMK KMS used to decrypt". kmsID is always the
+	// keyring's primary as the caller specified it (alias, bare ID, or
+	// ARN), used for every new Set; primaryKeyARN is its resolved ARN, used
+	// to recognize values that are already on the primary key.
+	trustedKeyIDs map[string]bool
+	primaryKeyARN string
+	autoRewrap    bool
 }
 
 var _ kv.Service = &awsKMS{}
@@ -53,6 +72,7 @@ func NewWithSession(sess *session.Session, store kv.Service, kmsID string, encry
 		kmsService:        kms.New(sess),
 		kmsID:             kmsID,
 		encryptionContext: aws.StringMap(encryptionContext),
+		dekCache:          newDEKCache(defaultDEKCacheMaxEntries, defaultDEKCacheTTL),
 	}, nil
 }
 
@@ -63,19 +83,145 @@ func New(store kv.Service, region string, kmsID string, encryptionContext map[st
 	return NewWithSession(sess, store, kmsID, encryptionContext)
 }
 
+// EnvelopeOptions configures the local data-encryption-key cache used by the
+// envelope-encryption mode.
+type EnvelopeOptions struct {
+	// CacheTTL is how long a decrypted data-encryption-key is kept in memory
+	// before it must be re-unwrapped via KMS. Zero disables expiry.
+	CacheTTL time.Duration
+	// CacheMaxEntries bounds how many distinct DEKs are kept in memory at
+	// once; the least recently used one is evicted past the limit. Zero
+	// falls back to defaultDEKCacheMaxEntries.
+	CacheMaxEntries int
+	// MaxEncryptionsPerDEK bounds how many AES-GCM seals are performed under
+	// a single cached DEK before Set requests a fresh one from KMS. Zero
+	// falls back to defaultMaxEncryptionsPerDEK.
+	MaxEncryptionsPerDEK int
+}
+
+// NewEnvelopeWithSession creates a new kv.Service encrypted by AWS KMS using
+// envelope encryption: Set generates (or reuses a cached) data-encryption-key
+// via kms.GenerateDataKey and seals the value locally with AES-256-GCM, so
+// only the wrapped DEK - not every value - needs a KMS round trip. Get still
+// transparently decrypts ciphertext produced by the direct-encrypt New/
+// NewWithSession path.
+func NewEnvelopeWithSession(sess *session.Session, store kv.Service, kmsID string, encryptionContext map[string]string, opts EnvelopeOptions) (kv.Service, error) {
+	if kmsID == "" {
+		return nil, errors.Errorf("invalid kmsID specified: '%s'", kmsID)
+	}
+
+	maxEntries := opts.CacheMaxEntries
+	if maxEntries <= 0 {
+		maxEntries = defaultDEKCacheMaxEntries
+	}
+
+	maxUses := opts.MaxEncryptionsPerDEK
+	if maxUses <= 0 {
+		maxUses = defaultMaxEncryptionsPerDEK
+	}
+
+	return &awsKMS{
+		store:                store,
+		kmsService:           kms.New(sess),
+		kmsID:                kmsID,
+		encryptionContext:    aws.StringMap(encryptionContext),
+		envelope:             true,
+		dekCache:             newDEKCache(maxEntries, opts.CacheTTL),
+		maxEncryptionsPerDEK: maxUses,
+	}, nil
+}
+
+// NewEnvelope creates a new kv.Service encrypted by AWS KMS using envelope
+// encryption, as NewEnvelopeWithSession but opening its own AWS Session for
+// the given region.
+func NewEnvelope(store kv.Service, region string, kmsID string, encryptionContext map[string]string, opts EnvelopeOptions) (kv.Service, error) {
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion(region)))
+
+	return NewEnvelopeWithSession(sess, store, kmsID, encryptionContext, opts)
+}
+
+// NewWithKeyringSession creates a new kv.Service encrypted by AWS KMS whose
+// Get trusts ciphertext wrapped by any CMK in keyIDs, while every Set always
+// writes under keyIDs[0] (the primary). This is how a CMK gets rotated
+// without downtime: put the new CMK first, keep the retiring ones in the
+// tail until Rewrap/RewrapAll has migrated everything, then drop them.
+// If autoRewrap is true, Get transparently re-encrypts under the primary and
+// writes the result back to store whenever it decrypts a non-primary value.
+func NewWithKeyringSession(sess *session.Session, store kv.Service, keyIDs []string, encryptionContext map[string]string, autoRewrap bool) (kv.Service, error) {
+	if len(keyIDs) == 0 {
+		return nil, errors.New("at least one KMS key ID must be specified")
+	}
+
+	kmsService := kms.New(sess)
+
+	trusted := make(map[string]bool, len(keyIDs))
+	primaryKeyARN := ""
+
+	for i, keyID := range keyIDs {
+		if keyID == "" {
+			return nil, errors.New("KMS keyring contains an empty key ID")
+		}
+
+		arn, err := resolveKeyARN(kmsService, keyID)
+		if err != nil {
+			return nil, err
+		}
+
+		trusted[arn] = true
+
+		if i == 0 {
+			primaryKeyARN = arn
+		}
+	}
+
+	return &awsKMS{
+		store:             store,
+		kmsService:        kmsService,
+		kmsID:             keyIDs[0],
+		encryptionContext: aws.StringMap(encryptionContext),
+		trustedKeyIDs:     trusted,
+		primaryKeyARN:     primaryKeyARN,
+		autoRewrap:        autoRewrap,
+		dekCache:          newDEKCache(defaultDEKCacheMaxEntries, defaultDEKCacheTTL),
+	}, nil
+}
+
+// NewWithKeyring creates a new kv.Service encrypted by AWS KMS with a keyring
+// of trusted decryption keys, as NewWithKeyringSession but opening its own
+// AWS Session for the given region.
+func NewWithKeyring(store kv.Service, region string, keyIDs []string, encryptionContext map[string]string, autoRewrap bool) (kv.Service, error) {
+	sess := session.Must(session.NewSession(aws.NewConfig().WithRegion(region)))
+
+	return NewWithKeyringSession(sess, store, keyIDs, encryptionContext, autoRewrap)
+}
+
+// decrypt decrypts cipherText with KMS, discarding which CMK performed the
+// decryption; decryptChecked is used where that matters (the keyring
+// allow-list and auto-rewrap, see keyring.go).
 func (a *awsKMS) decrypt(cipherText []byte) ([]byte, error) {
+	plainText, _, err := a.decryptChecked(cipherText)
+
+	return plainText, err
+}
+
+func (a *awsKMS) decryptChecked(cipherText []byte) ([]byte, string, error) {
 	out, err := a.kmsService.Decrypt(&kms.DecryptInput{
 		CiphertextBlob:    cipherText,
 		EncryptionContext: a.encryptionContext,
 		GrantTokens:       []*string{},
 	})
 	if err != nil {
-		return nil, errors.WrapIf(err, "failed to decrypt with KMS client")
+		return nil, "", errors.WrapIf(err, "failed to decrypt with KMS client")
+	}
+
+	keyID := aws.StringValue(out.KeyId)
+	if err := a.checkTrusted(keyID); err != nil {
+		return nil, "", err
 	}
 
 	trimKey := strings.TrimSpace(string(out.Plaintext))
 
-	return []byte(trimKey), nil
+	return []byte(trimKey), keyID, nil
 }
 
 func (a *awsKMS) Get(key string) ([]byte, error) {
@@ -84,7 +230,28 @@ func (a *awsKMS) Get(key string) ([]byte, error) {
 		return nil, errors.WrapIf(err, "failed to get data for KMS client")
 	}
 
-	return a.decrypt(cipherText)
+	var (
+		plainText []byte
+		keyID     string
+	)
+
+	if isEnvelope(cipherText) {
+		plainText, keyID, err = a.decryptEnvelopeChecked(cipherText)
+	} else {
+		plainText, keyID, err = a.decryptChecked(cipherText)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if a.autoRewrap && keyID != "" && !a.isPrimary(keyID) {
+		// Best-effort: a failed rewrap shouldn't fail a read that already
+		// succeeded, it just leaves the value on the older CMK until the
+		// next Get, or an explicit Rewrap/RewrapAll.
+		_ = a.rewrapValue(key, plainText)
+	}
+
+	return plainText, nil
 }
 
 func (a *awsKMS) encrypt(plainText []byte) ([]byte, error) {
@@ -102,7 +269,16 @@ func (a *awsKMS) encrypt(plainText []byte) ([]byte, error) {
 }
 
 func (a *awsKMS) Set(key string, val []byte) error {
-	cipherText, err := a.encrypt(val)
+	var (
+		cipherText []byte
+		err        error
+	)
+
+	if a.envelope {
+		cipherText, err = a.encryptEnvelope(val)
+	} else {
+		cipherText, err = a.encrypt(val)
+	}
 	if err != nil {
 		return err
 	}
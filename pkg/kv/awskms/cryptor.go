@@ -0,0 +1,75 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awskms
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// Cryptor is the direct-ciphertext half of the KMS wrapper: callers that
+// already hold a value in memory and don't want the store.Get/store.Set
+// round trip - pkg/kv/sqlcrypto and pkg/kv/decryptstart, for instance - can
+// use it instead of going through the kv.Service Get/Set pair.
+type Cryptor interface {
+	Encrypt(plainText []byte) ([]byte, error)
+	Decrypt(cipherText []byte) ([]byte, error)
+}
+
+var _ Cryptor = &awsKMS{}
+
+// NewRawDecrypter builds an awsKMS usable only as a Cryptor, without a
+// backing kv.Service store. It's what decrypt-and-start uses to turn a
+// ciphertext baked into a container env var into plaintext, without a
+// Get/store round trip. kmsID may be an alias, a bare key ID, or an ARN; it
+// is resolved to its canonical ARN up front so that the keyring trust check
+// in Decrypt recognizes values wrapped under it.
+func NewRawDecrypter(kmsService *kms.KMS, kmsID string, encryptionContext map[string]string) (Cryptor, error) {
+	arn, err := resolveKeyARN(kmsService, kmsID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &awsKMS{
+		kmsService:        kmsService,
+		kmsID:             kmsID,
+		primaryKeyARN:     arn,
+		encryptionContext: aws.StringMap(encryptionContext),
+		trustedKeyIDs:     map[string]bool{arn: true},
+		dekCache:          newDEKCache(defaultDEKCacheMaxEntries, defaultDEKCacheTTL),
+	}, nil
+}
+
+// Encrypt seals plainText the same way Set does, without writing it to the
+// backing store.
+func (a *awsKMS) Encrypt(plainText []byte) ([]byte, error) {
+	if a.envelope {
+		return a.encryptEnvelope(plainText)
+	}
+
+	return a.encrypt(plainText)
+}
+
+// Decrypt opens cipherText the same way Get does, auto-detecting the
+// envelope vs. direct-encrypt wire format, but without reading it from a
+// backing store first - for callers that already have the ciphertext in
+// hand.
+func (a *awsKMS) Decrypt(cipherText []byte) ([]byte, error) {
+	if isEnvelope(cipherText) {
+		return a.decryptEnvelope(cipherText)
+	}
+
+	return a.decrypt(cipherText)
+}
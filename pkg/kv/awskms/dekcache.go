@@ -0,0 +1,205 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awskms
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDEKCacheMaxEntries bounds how many distinct data-encryption-keys
+	// are kept in memory by default.
+	defaultDEKCacheMaxEntries = 128
+
+	// defaultDEKCacheTTL is how long a cached data-encryption-key is trusted
+	// before it has to be re-unwrapped via KMS.
+	defaultDEKCacheTTL = 10 * time.Minute
+)
+
+// dekEntry holds a cached plaintext data-encryption-key, its KMS-wrapped
+// form, and the bookkeeping needed to enforce a TTL and a reuse budget.
+type dekEntry struct {
+	key       string
+	plaintext []byte
+	wrapped   []byte
+	// keyID is the CMK that wrapped this DEK, cached alongside the plaintext
+	// so a DEK cache hit can still report it for the primary-key/auto-rewrap
+	// decision without a fresh KMS call. A hit does not re-check the keyring
+	// allow-list; DEKs are cached only after passing it (see keyring.go).
+	keyID     string
+	useCount  int
+	expiresAt time.Time
+}
+
+// zero overwrites the plaintext DEK in place so it doesn't linger in memory
+// once the entry is evicted.
+func (e *dekEntry) zero() {
+	for i := range e.plaintext {
+		e.plaintext[i] = 0
+	}
+}
+
+// clone returns a copy of entry with its own plaintext backing array. get
+// hands out clones rather than the cache's own entry, because the original
+// can be zeroed in place by a concurrent put/eviction of some unrelated key
+// - the cache is sized and evicted independently of how long a caller holds
+// on to a DEK it already fetched.
+func (e *dekEntry) clone() *dekEntry {
+	return &dekEntry{
+		key:       e.key,
+		plaintext: cloneBytes(e.plaintext),
+		wrapped:   e.wrapped,
+		keyID:     e.keyID,
+		expiresAt: e.expiresAt,
+	}
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	out := make([]byte, len(b))
+	copy(out, b)
+
+	return out
+}
+
+// dekCache is a small thread-safe LRU cache of unwrapped data-encryption-keys,
+// so repeated Get/Set calls don't each cost a KMS Decrypt/GenerateDataKey
+// round trip just to (un)wrap the DEK.
+type dekCache struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	maxItems int
+	items    map[string]*list.Element
+	order    *list.List
+
+	// currentKey is the cache key of the DEK currently designated for new
+	// Set writes. It lives here, rather than on awsKMS, so it shares this
+	// cache's mutex instead of needing one of its own.
+	currentKey string
+}
+
+func newDEKCache(maxItems int, ttl time.Duration) *dekCache {
+	return &dekCache{
+		ttl:      ttl,
+		maxItems: maxItems,
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *dekCache) get(key string) (*dekEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry, _ := elem.Value.(*dekEntry)
+	if c.ttl > 0 && time.Now().After(entry.expiresAt) {
+		c.removeElementLocked(elem)
+
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+
+	// Hand back a clone, never the cache's own entry: the caller is going
+	// to use entry.plaintext after this method - and this mutex - has been
+	// released, while the cache can still zero the original in place the
+	// moment some other key's put/eviction happens.
+	return entry.clone(), true
+}
+
+// put inserts entry, evicting the least-recently-used entry if the cache is
+// over capacity, and zeroing out any plaintext DEK it replaces or evicts.
+func (c *dekCache) put(entry *dekEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl > 0 {
+		entry.expiresAt = time.Now().Add(c.ttl)
+	}
+
+	if elem, ok := c.items[entry.key]; ok {
+		old, _ := elem.Value.(*dekEntry)
+		old.zero()
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+
+		return
+	}
+
+	elem := c.order.PushFront(entry)
+	c.items[entry.key] = elem
+
+	for c.maxItems > 0 && c.order.Len() > c.maxItems {
+		c.evictOldestLocked()
+	}
+}
+
+// incrementUse records one more encryption performed under the cached DEK
+// identified by key and reports whether maxUses has now been reached.
+func (c *dekCache) incrementUse(key string, maxUses int) (uses int, exhausted bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return 0, false
+	}
+
+	entry, _ := elem.Value.(*dekEntry)
+	entry.useCount++
+
+	return entry.useCount, maxUses > 0 && entry.useCount >= maxUses
+}
+
+// current returns the cache key of the DEK designated for new writes, or ""
+// if none is set.
+func (c *dekCache) current() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.currentKey
+}
+
+// setCurrent records which cached DEK new writes should use; pass "" to
+// force the next write to request a fresh DEK from KMS.
+func (c *dekCache) setCurrent(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.currentKey = key
+}
+
+func (c *dekCache) evictOldestLocked() {
+	if elem := c.order.Back(); elem != nil {
+		c.removeElementLocked(elem)
+	}
+}
+
+func (c *dekCache) removeElementLocked(elem *list.Element) {
+	entry, _ := elem.Value.(*dekEntry)
+	entry.zero()
+	c.order.Remove(elem)
+	delete(c.items, entry.key)
+}
@@ -0,0 +1,148 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awskms
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDekCacheGetReturnsClone(t *testing.T) {
+	c := newDEKCache(8, 0)
+	c.put(&dekEntry{key: "k", plaintext: []byte("secret")})
+
+	got, ok := c.get("k")
+	if !ok {
+		t.Fatal("get() ok = false, want true")
+	}
+
+	got.plaintext[0] = 'X'
+
+	got2, ok := c.get("k")
+	if !ok {
+		t.Fatal("get() ok = false, want true")
+	}
+
+	if string(got2.plaintext) != "secret" {
+		t.Errorf("cached plaintext was mutated via a returned clone: got %q", got2.plaintext)
+	}
+}
+
+func TestDekCacheGetSurvivesConcurrentEviction(t *testing.T) {
+	c := newDEKCache(1, 0)
+	c.put(&dekEntry{key: "a", plaintext: []byte("aaaa")})
+
+	entry, ok := c.get("a")
+	if !ok {
+		t.Fatal("get() ok = false, want true")
+	}
+
+	// Evict "a" by inserting past capacity, simulating another goroutine's
+	// unrelated traffic while entry is still in use by this caller.
+	c.put(&dekEntry{key: "b", plaintext: []byte("bbbb")})
+
+	if string(entry.plaintext) != "aaaa" {
+		t.Errorf("entry.plaintext = %q after eviction of its key, want unchanged %q", entry.plaintext, "aaaa")
+	}
+}
+
+func TestDekCacheLRUEviction(t *testing.T) {
+	c := newDEKCache(2, 0)
+	c.put(&dekEntry{key: "a", plaintext: []byte("a")})
+	c.put(&dekEntry{key: "b", plaintext: []byte("b")})
+
+	// Touch "a" so "b" becomes the least-recently-used entry.
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("get(a) ok = false, want true")
+	}
+
+	c.put(&dekEntry{key: "c", plaintext: []byte("c")})
+
+	if _, ok := c.get("b"); ok {
+		t.Error("get(b) ok = true, want false: b should have been evicted as least-recently-used")
+	}
+
+	if _, ok := c.get("a"); !ok {
+		t.Error("get(a) ok = false, want true: a was touched and should have survived eviction")
+	}
+
+	if _, ok := c.get("c"); !ok {
+		t.Error("get(c) ok = false, want true")
+	}
+}
+
+func TestDekCacheTTLExpiry(t *testing.T) {
+	c := newDEKCache(8, time.Millisecond)
+	c.put(&dekEntry{key: "k", plaintext: []byte("secret")})
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.get("k"); ok {
+		t.Error("get() ok = true after TTL expiry, want false")
+	}
+}
+
+func TestDekCacheIncrementUseExhausted(t *testing.T) {
+	c := newDEKCache(8, 0)
+	c.put(&dekEntry{key: "k", plaintext: []byte("secret")})
+
+	uses, exhausted := c.incrementUse("k", 2)
+	if uses != 1 || exhausted {
+		t.Errorf("incrementUse #1 = (%d, %v), want (1, false)", uses, exhausted)
+	}
+
+	uses, exhausted = c.incrementUse("k", 2)
+	if uses != 2 || !exhausted {
+		t.Errorf("incrementUse #2 = (%d, %v), want (2, true)", uses, exhausted)
+	}
+}
+
+func TestDekCacheCurrentKey(t *testing.T) {
+	c := newDEKCache(8, 0)
+
+	if got := c.current(); got != "" {
+		t.Errorf("current() = %q, want empty", got)
+	}
+
+	c.setCurrent("k")
+
+	if got := c.current(); got != "k" {
+		t.Errorf("current() = %q, want %q", got, "k")
+	}
+}
+
+func TestDekCacheConcurrentAccess(t *testing.T) {
+	c := newDEKCache(16, 0)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			key := string(rune('a' + i%16))
+			c.put(&dekEntry{key: key, plaintext: []byte("plaintext-value")})
+
+			if entry, ok := c.get(key); ok {
+				_ = entry.plaintext[0]
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
@@ -0,0 +1,295 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awskms
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"emperror.dev/errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// envelopeMagic identifies the envelope wire format so Get can auto-detect
+// it and keep reading ciphertext produced by the direct-encrypt New path.
+var envelopeMagic = []byte("BVK1")
+
+const (
+	envelopeVersion = 1
+
+	// nonceSize is the standard AES-GCM nonce size.
+	nonceSize = 12
+
+	// defaultMaxEncryptionsPerDEK bounds how many times a cached DEK is
+	// reused for Set before a fresh one is requested from KMS, keeping the
+	// random-nonce collision probability negligible.
+	defaultMaxEncryptionsPerDEK = 1 << 20
+)
+
+// isEnvelope reports whether cipherText carries the envelope magic header.
+func isEnvelope(cipherText []byte) bool {
+	return len(cipherText) >= len(envelopeMagic) && bytes.Equal(cipherText[:len(envelopeMagic)], envelopeMagic)
+}
+
+// contextFingerprint produces a stable, order-independent identifier for an
+// encryption context, used as part of the DEK cache key so a cached DEK is
+// never reused across contexts.
+func contextFingerprint(encryptionContext map[string]*string) string {
+	keys := make([]string, 0, len(encryptionContext))
+	for k := range encryptionContext {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	h := sha256.New()
+
+	for _, k := range keys {
+		_, _ = h.Write([]byte(k))
+		_, _ = h.Write([]byte{0})
+
+		if v := encryptionContext[k]; v != nil {
+			_, _ = h.Write([]byte(*v))
+		}
+
+		_, _ = h.Write([]byte{0})
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// dekCacheKey derives the DEK cache key from the wrapped (KMS-encrypted) DEK
+// and the encryption context it was generated under.
+func dekCacheKey(wrappedDEK []byte, encryptionContext map[string]*string) string {
+	h := sha256.Sum256(wrappedDEK)
+
+	return fmt.Sprintf("%x:%s", h, contextFingerprint(encryptionContext))
+}
+
+// encryptEnvelope implements the envelope-encryption Set path: a cached
+// data-encryption-key is reused for up to maxEncryptionsPerDEK AES-256-GCM
+// seals before a fresh one is requested from KMS.
+func (a *awsKMS) encryptEnvelope(plainText []byte) ([]byte, error) {
+	entry := a.currentDEK()
+	if entry == nil {
+		var err error
+
+		entry, err = a.generateDEK()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.WrapIf(err, "failed to generate nonce for envelope encryption")
+	}
+
+	ciphertext, err := sealGCM(entry.plaintext, nonce, plainText)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, exhausted := a.dekCache.incrementUse(entry.key, a.maxEncryptionsPerDEK); exhausted {
+		a.dekCache.setCurrent("")
+	}
+
+	return marshalEnvelope(entry.wrapped, nonce, ciphertext), nil
+}
+
+// decryptEnvelope decrypts an envelope-format ciphertext, discarding which
+// CMK wrapped the DEK; decryptEnvelopeChecked is used where that matters
+// (the keyring allow-list and auto-rewrap, see keyring.go).
+func (a *awsKMS) decryptEnvelope(cipherText []byte) ([]byte, error) {
+	plainText, _, err := a.decryptEnvelopeChecked(cipherText)
+
+	return plainText, err
+}
+
+// decryptEnvelopeChecked implements the Get path for the envelope wire
+// format: the wrapped DEK is looked up in the local cache first, and only
+// unwrapped via kms.Decrypt on a cache miss.
+func (a *awsKMS) decryptEnvelopeChecked(cipherText []byte) ([]byte, string, error) {
+	wrapped, nonce, ciphertext, err := unmarshalEnvelope(cipherText)
+	if err != nil {
+		return nil, "", err
+	}
+
+	cacheKey := dekCacheKey(wrapped, a.encryptionContext)
+
+	entry, ok := a.dekCache.get(cacheKey)
+	if !ok {
+		out, err := a.kmsService.Decrypt(&kms.DecryptInput{
+			CiphertextBlob:    wrapped,
+			EncryptionContext: a.encryptionContext,
+			GrantTokens:       []*string{},
+		})
+		if err != nil {
+			return nil, "", errors.WrapIf(err, "failed to unwrap data encryption key with KMS client")
+		}
+
+		keyID := aws.StringValue(out.KeyId)
+		if err := a.checkTrusted(keyID); err != nil {
+			return nil, "", err
+		}
+
+		// The cache gets its own copy of the plaintext DEK; entry keeps
+		// out.Plaintext for this call's immediate use below, so a
+		// concurrent eviction zeroing the cached copy can't race with it.
+		entry = &dekEntry{key: cacheKey, plaintext: out.Plaintext, wrapped: wrapped, keyID: keyID}
+		a.dekCache.put(entry.clone())
+	}
+
+	plainText, err := openGCM(entry.plaintext, nonce, ciphertext)
+	if err != nil {
+		return nil, "", errors.WrapIf(err, "failed to open envelope ciphertext")
+	}
+
+	return plainText, entry.keyID, nil
+}
+
+// generateDEK asks KMS for a new data-encryption-key and caches it as the
+// current DEK so subsequent Set calls can reuse it without another KMS round
+// trip.
+func (a *awsKMS) generateDEK() (*dekEntry, error) {
+	out, err := a.kmsService.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:             aws.String(a.kmsID),
+		KeySpec:           aws.String(kms.DataKeySpecAes256),
+		EncryptionContext: a.encryptionContext,
+		GrantTokens:       []*string{},
+	})
+	if err != nil {
+		return nil, errors.WrapIf(err, "failed to generate data encryption key with KMS client")
+	}
+
+	cacheKey := dekCacheKey(out.CiphertextBlob, a.encryptionContext)
+	// The cache gets its own copy of the plaintext DEK; entry keeps
+	// out.Plaintext for the caller's immediate use, so a concurrent
+	// eviction zeroing the cached copy can't race with it.
+	entry := &dekEntry{key: cacheKey, plaintext: out.Plaintext, wrapped: out.CiphertextBlob, keyID: aws.StringValue(out.KeyId)}
+
+	a.dekCache.put(entry.clone())
+	a.dekCache.setCurrent(cacheKey)
+
+	return entry, nil
+}
+
+// currentDEK returns the cached DEK designated for new writes, if it's still
+// present - it may have been evicted by TTL, LRU pressure, or a previous
+// exhausted reuse budget.
+func (a *awsKMS) currentDEK() *dekEntry {
+	key := a.dekCache.current()
+	if key == "" {
+		return nil
+	}
+
+	entry, ok := a.dekCache.get(key)
+	if !ok {
+		return nil
+	}
+
+	return entry
+}
+
+func sealGCM(plaintextDEK, nonce, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(plaintextDEK)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func openGCM(plaintextDEK, nonce, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(plaintextDEK)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(plaintextDEK []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(plaintextDEK)
+	if err != nil {
+		return nil, errors.WrapIf(err, "failed to create AES cipher for envelope encryption")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.WrapIf(err, "failed to create AES-GCM for envelope encryption")
+	}
+
+	return gcm, nil
+}
+
+// marshalEnvelope lays out the wire format written to the backing store:
+// MAGIC(4) | VERSION(1) | wrappedLen(2) | wrapped | nonce(12) | ct||tag.
+func marshalEnvelope(wrapped, nonce, ciphertext []byte) []byte {
+	buf := make([]byte, 0, len(envelopeMagic)+1+2+len(wrapped)+len(nonce)+len(ciphertext))
+
+	buf = append(buf, envelopeMagic...)
+	buf = append(buf, envelopeVersion)
+
+	wrappedLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(wrappedLen, uint16(len(wrapped)))
+	buf = append(buf, wrappedLen...)
+
+	buf = append(buf, wrapped...)
+	buf = append(buf, nonce...)
+	buf = append(buf, ciphertext...)
+
+	return buf
+}
+
+func unmarshalEnvelope(blob []byte) (wrapped, nonce, ciphertext []byte, err error) {
+	const headerLen = 4 + 1 + 2 // magic + version + wrappedLen
+
+	if len(blob) < headerLen {
+		return nil, nil, nil, errors.New("envelope ciphertext is too short to contain a header")
+	}
+
+	if !bytes.Equal(blob[:len(envelopeMagic)], envelopeMagic) {
+		return nil, nil, nil, errors.New("envelope ciphertext has an unrecognized magic header")
+	}
+
+	if version := blob[len(envelopeMagic)]; version != envelopeVersion {
+		return nil, nil, nil, errors.Errorf("unsupported envelope format version: %d", version)
+	}
+
+	wrappedLen := int(binary.BigEndian.Uint16(blob[len(envelopeMagic)+1 : headerLen]))
+
+	// ct||tag can never be shorter than the AES-GCM authentication tag.
+	const gcmTagSize = 16
+
+	rest := blob[headerLen:]
+	if len(rest) < wrappedLen+nonceSize+gcmTagSize {
+		return nil, nil, nil, errors.New("envelope ciphertext is truncated")
+	}
+
+	wrapped = rest[:wrappedLen]
+	rest = rest[wrappedLen:]
+	nonce = rest[:nonceSize]
+	ciphertext = rest[nonceSize:]
+
+	return wrapped, nonce, ciphertext, nil
+}
@@ -0,0 +1,139 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awskms
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarshalUnmarshalEnvelopeRoundTrip(t *testing.T) {
+	wrapped := []byte("wrapped-dek")
+	nonce := []byte("123456789012")
+	ciphertext := []byte("ciphertext-and-tag")
+
+	blob := marshalEnvelope(wrapped, nonce, ciphertext)
+	if !isEnvelope(blob) {
+		t.Fatal("marshalEnvelope output not recognized by isEnvelope")
+	}
+
+	gotWrapped, gotNonce, gotCiphertext, err := unmarshalEnvelope(blob)
+	if err != nil {
+		t.Fatalf("unmarshalEnvelope() error = %v", err)
+	}
+
+	if !bytes.Equal(gotWrapped, wrapped) {
+		t.Errorf("wrapped = %q, want %q", gotWrapped, wrapped)
+	}
+
+	if !bytes.Equal(gotNonce, nonce) {
+		t.Errorf("nonce = %q, want %q", gotNonce, nonce)
+	}
+
+	if !bytes.Equal(gotCiphertext, ciphertext) {
+		t.Errorf("ciphertext = %q, want %q", gotCiphertext, ciphertext)
+	}
+}
+
+func TestUnmarshalEnvelopeErrors(t *testing.T) {
+	valid := marshalEnvelope([]byte("wrapped"), []byte("123456789012"), []byte("ct"))
+
+	tests := map[string][]byte{
+		"too short":         {0x01, 0x02},
+		"wrong magic":       append([]byte("XXXX"), valid[len(envelopeMagic):]...),
+		"unsupported version": func() []byte {
+			b := append([]byte(nil), valid...)
+			b[len(envelopeMagic)] = envelopeVersion + 1
+
+			return b
+		}(),
+		"truncated body": valid[:len(valid)-1],
+	}
+
+	for name, blob := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, _, _, err := unmarshalEnvelope(blob); err == nil {
+				t.Fatal("unmarshalEnvelope() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestIsEnvelopeDoesNotMatchDirectCiphertext(t *testing.T) {
+	if isEnvelope([]byte("some opaque KMS ciphertext blob")) {
+		t.Fatal("isEnvelope() = true for non-envelope ciphertext")
+	}
+
+	if isEnvelope(nil) {
+		t.Fatal("isEnvelope(nil) = true")
+	}
+}
+
+func TestSealOpenGCMRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	nonce := []byte("123456789012")
+	plaintext := []byte("super secret value")
+
+	ciphertext, err := sealGCM(key, nonce, plaintext)
+	if err != nil {
+		t.Fatalf("sealGCM() error = %v", err)
+	}
+
+	got, err := openGCM(key, nonce, ciphertext)
+	if err != nil {
+		t.Fatalf("openGCM() error = %v", err)
+	}
+
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("openGCM() = %q, want %q", got, plaintext)
+	}
+
+	// A bit flip anywhere in the sealed blob must fail authentication rather
+	// than silently returning corrupted plaintext.
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[0] ^= 0xFF
+
+	if _, err := openGCM(key, nonce, tampered); err == nil {
+		t.Fatal("openGCM() on tampered ciphertext error = nil, want error")
+	}
+}
+
+func TestContextFingerprintOrderIndependent(t *testing.T) {
+	a := map[string]*string{"foo": strPtr("1"), "bar": strPtr("2")}
+	b := map[string]*string{"bar": strPtr("2"), "foo": strPtr("1")}
+
+	if contextFingerprint(a) != contextFingerprint(b) {
+		t.Error("contextFingerprint depends on map iteration order")
+	}
+
+	c := map[string]*string{"foo": strPtr("1"), "bar": strPtr("3")}
+	if contextFingerprint(a) == contextFingerprint(c) {
+		t.Error("contextFingerprint did not change with a different value")
+	}
+}
+
+func TestDekCacheKeyDiffersByContext(t *testing.T) {
+	wrapped := []byte("wrapped-dek")
+	ctxA := map[string]*string{"tenant": strPtr("a")}
+	ctxB := map[string]*string{"tenant": strPtr("b")}
+
+	if dekCacheKey(wrapped, ctxA) == dekCacheKey(wrapped, ctxB) {
+		t.Error("dekCacheKey collided across different encryption contexts")
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,133 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awskms
+
+import (
+	"context"
+
+	"emperror.dev/errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// resolveKeyARN resolves a key ID, alias, or ARN to its canonical key ARN via
+// DescribeKey. KMS's Decrypt/GenerateDataKey output always reports the key
+// that was used as a full ARN - never an alias or bare key ID - so the
+// keyring's allow-list has to be built, and compared against, in terms of
+// ARNs regardless of how the caller configured each key.
+func resolveKeyARN(kmsService *kms.KMS, keyID string) (string, error) {
+	out, err := kmsService.DescribeKey(&kms.DescribeKeyInput{KeyId: aws.String(keyID)})
+	if err != nil {
+		return "", errors.WrapIff(err, "failed to resolve KMS key %q to its ARN", keyID)
+	}
+
+	return aws.StringValue(out.KeyMetadata.Arn), nil
+}
+
+// checkTrusted rejects ciphertext that was wrapped by a CMK outside the
+// keyring. KMS picks the CMK to use for Decrypt from the ciphertext blob
+// itself, so the keyring's only job on the read path is this allow-list
+// check; trustedKeyIDs being nil (no keyring configured) means "trust
+// whatever CMK KMS used".
+func (a *awsKMS) checkTrusted(keyID string) error {
+	if a.trustedKeyIDs == nil {
+		return nil
+	}
+
+	if !a.trustedKeyIDs[keyID] {
+		return errors.Errorf("ciphertext was wrapped by untrusted KMS key %q", keyID)
+	}
+
+	return nil
+}
+
+// isPrimary reports whether keyID (a canonical key ARN, as returned by KMS)
+// is the keyring's primary key. Without a keyring configured, every value is
+// necessarily on the only key there is, so it's treated as primary too.
+func (a *awsKMS) isPrimary(keyID string) bool {
+	if a.trustedKeyIDs == nil {
+		return true
+	}
+
+	return keyID == a.primaryKeyARN
+}
+
+// rewrapValue re-encrypts plainText under the primary KMS key and writes it
+// back to the store under key.
+func (a *awsKMS) rewrapValue(key string, plainText []byte) error {
+	var (
+		cipherText []byte
+		err        error
+	)
+
+	if a.envelope {
+		cipherText, err = a.encryptEnvelope(plainText)
+	} else {
+		cipherText, err = a.encrypt(plainText)
+	}
+	if err != nil {
+		return errors.WrapIf(err, "failed to re-encrypt value under the primary KMS key")
+	}
+
+	return a.store.Set(key, cipherText)
+}
+
+// Rewrap re-encrypts the value stored under key with the primary KMS key, if
+// it isn't already, regardless of whether autoRewrap is enabled. It's a
+// no-op if the value is already wrapped by the primary key.
+func (a *awsKMS) Rewrap(key string) error {
+	cipherText, err := a.store.Get(key)
+	if err != nil {
+		return errors.WrapIf(err, "failed to get data for KMS client")
+	}
+
+	var (
+		plainText []byte
+		keyID     string
+	)
+
+	if isEnvelope(cipherText) {
+		plainText, keyID, err = a.decryptEnvelopeChecked(cipherText)
+	} else {
+		plainText, keyID, err = a.decryptChecked(cipherText)
+	}
+	if err != nil {
+		return err
+	}
+
+	if a.isPrimary(keyID) {
+		return nil
+	}
+
+	return a.rewrapValue(key, plainText)
+}
+
+// RewrapAll calls Rewrap for every key in keys, stopping as soon as ctx is
+// canceled or a key fails to rewrap. It's meant for offline migration after
+// a CMK rotation: kv.Service has no way to enumerate its own keys, so the
+// caller supplies the list (e.g. read from the backing store directly).
+func (a *awsKMS) RewrapAll(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := a.Rewrap(key); err != nil {
+			return errors.WrapIff(err, "failed to rewrap key %q", key)
+		}
+	}
+
+	return nil
+}
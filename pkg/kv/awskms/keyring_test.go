@@ -0,0 +1,65 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package awskms
+
+import "testing"
+
+func TestCheckTrustedNoKeyringTrustsAnything(t *testing.T) {
+	a := &awsKMS{}
+
+	if err := a.checkTrusted("arn:aws:kms:us-east-1:111122223333:key/any"); err != nil {
+		t.Errorf("checkTrusted() error = %v, want nil when no keyring is configured", err)
+	}
+}
+
+func TestCheckTrustedRejectsUnlistedKey(t *testing.T) {
+	primary := "arn:aws:kms:us-east-1:111122223333:key/primary"
+	a := &awsKMS{trustedKeyIDs: map[string]bool{primary: true}}
+
+	if err := a.checkTrusted(primary); err != nil {
+		t.Errorf("checkTrusted(primary) error = %v, want nil", err)
+	}
+
+	other := "arn:aws:kms:us-east-1:111122223333:key/other"
+	if err := a.checkTrusted(other); err == nil {
+		t.Error("checkTrusted(other) error = nil, want error for a key outside the keyring")
+	}
+}
+
+func TestIsPrimaryNoKeyringTreatsEverythingAsPrimary(t *testing.T) {
+	a := &awsKMS{}
+
+	if !a.isPrimary("arn:aws:kms:us-east-1:111122223333:key/any") {
+		t.Error("isPrimary() = false, want true when no keyring is configured")
+	}
+}
+
+func TestIsPrimaryComparesAgainstPrimaryKeyARN(t *testing.T) {
+	primary := "arn:aws:kms:us-east-1:111122223333:key/primary"
+	secondary := "arn:aws:kms:us-east-1:111122223333:key/secondary"
+
+	a := &awsKMS{
+		primaryKeyARN: primary,
+		trustedKeyIDs: map[string]bool{primary: true, secondary: true},
+	}
+
+	if !a.isPrimary(primary) {
+		t.Error("isPrimary(primary) = false, want true")
+	}
+
+	if a.isPrimary(secondary) {
+		t.Error("isPrimary(secondary) = true, want false")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cloudsecrets
+
+import (
+	"context"
+	"testing"
+
+	"emperror.dev/errors"
+)
+
+// memStore is an in-memory kv.Service used so these tests can exercise the
+// Keeper encrypt/decrypt round trip without a real backing store.
+type memStore struct {
+	data map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{data: make(map[string][]byte)}
+}
+
+func (m *memStore) Get(key string) ([]byte, error) {
+	val, ok := m.data[key]
+	if !ok {
+		return nil, errors.Errorf("key %q not found", key)
+	}
+
+	return val, nil
+}
+
+func (m *memStore) Set(key string, val []byte) error {
+	m.data[key] = val
+
+	return nil
+}
+
+func TestCloudSecretsGetSetRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+
+	svc, err := New(ctx, store, "base64key://")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if err := svc.Set("greeting", []byte("hello world")); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+
+	// The backing store must only ever see ciphertext, never the plaintext
+	// that was passed to Set.
+	stored, err := store.Get("greeting")
+	if err != nil {
+		t.Fatalf("store.Get() error = %v", err)
+	}
+
+	if string(stored) == "hello world" {
+		t.Error("backing store holds plaintext; Set should have encrypted it first")
+	}
+
+	got, err := svc.Get("greeting")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if string(got) != "hello world" {
+		t.Errorf("Get() = %q, want %q", got, "hello world")
+	}
+}
+
+func TestCloudSecretsGetPropagatesStoreError(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+
+	svc, err := New(ctx, store, "base64key://")
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if _, err := svc.Get("missing"); err == nil {
+		t.Fatal("Get() error = nil, want error for a key missing from the backing store")
+	}
+}
+
+func TestNewRejectsUnresolvableKeeperURL(t *testing.T) {
+	ctx := context.Background()
+	store := newMemStore()
+
+	if _, err := New(ctx, store, "not-a-registered-scheme://whatever"); err == nil {
+		t.Fatal("New() error = nil, want error for an unregistered keeper scheme")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package decryptstart implements the decrypt-and-start pattern: scan the
+// process environment for KMS-encrypted values, decrypt them in place, and
+// exec a child process with the plaintext environment, so container images
+// don't each need a bespoke shell wrapper to pull secrets out of env vars.
+package decryptstart
+
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"emperror.dev/errors"
+)
+
+// Decrypter decrypts a raw ciphertext payload, bypassing any backing store.
+// awskms.Cryptor (and, symmetrically, future gcpkms/azurekms wrappers)
+// implements this directly against its KMS client.
+type Decrypter interface {
+	Decrypt(cipherText []byte) ([]byte, error)
+}
+
+// Options configures the environment scan.
+type Options struct {
+	// Prefixes are the env var value prefixes that mark a KMS-encrypted
+	// value, e.g. "kms:" or "decrypt:". The remainder of the value is
+	// base64-encoded ciphertext, or "@/path/to/file" to read it from a file.
+	Prefixes []string
+	// Strict aborts the whole run if any prefixed value fails to decrypt,
+	// instead of leaving that one variable untouched.
+	Strict bool
+}
+
+// Run decrypts every matching variable in os.Environ() with decrypter and
+// execs command (argv[0] plus its arguments) with the decrypted environment,
+// replacing the current process so it stays PID 1-friendly.
+func Run(decrypter Decrypter, command []string, opts Options) error {
+	if len(command) == 0 {
+		return errors.New("no command given to exec after decrypting the environment")
+	}
+
+	environ, err := decryptEnviron(decrypter, os.Environ(), opts)
+	if err != nil {
+		return err
+	}
+
+	argv0, err := exec.LookPath(command[0])
+	if err != nil {
+		return errors.WrapIff(err, "failed to locate command %q", command[0])
+	}
+
+	return syscall.Exec(argv0, command, environ)
+}
+
+func decryptEnviron(decrypter Decrypter, environ []string, opts Options) ([]string, error) {
+	out := make([]string, len(environ))
+
+	for i, kv := range environ {
+		name, value, ok := splitEnv(kv)
+		if !ok {
+			out[i] = kv
+
+			continue
+		}
+
+		prefix, rest, ok := matchPrefix(value, opts.Prefixes)
+		if !ok {
+			out[i] = kv
+
+			continue
+		}
+
+		plainText, err := decryptOne(decrypter, rest)
+		if err != nil {
+			err = errors.WrapIff(err, "failed to decrypt env var %q with prefix %q", name, prefix)
+			if opts.Strict {
+				return nil, err
+			}
+
+			out[i] = kv
+
+			continue
+		}
+
+		out[i] = name + "=" + string(plainText)
+	}
+
+	return out, nil
+}
+
+func decryptOne(decrypter Decrypter, rest string) ([]byte, error) {
+	encoded := rest
+
+	if file, ok := strings.CutPrefix(rest, "@"); ok {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, errors.WrapIf(err, "failed to read ciphertext file")
+		}
+
+		encoded = strings.TrimSpace(string(content))
+	}
+
+	cipherText, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.WrapIf(err, "failed to base64-decode ciphertext")
+	}
+
+	return decrypter.Decrypt(cipherText)
+}
+
+func splitEnv(kv string) (name, value string, ok bool) {
+	idx := strings.IndexByte(kv, '=')
+	if idx < 0 {
+		return "", "", false
+	}
+
+	return kv[:idx], kv[idx+1:], true
+}
+
+func matchPrefix(value string, prefixes []string) (prefix, rest string, ok bool) {
+	for _, p := range prefixes {
+		if strings.HasPrefix(value, p) {
+			return p, value[len(p):], true
+		}
+	}
+
+	return "", "", false
+}
@@ -0,0 +1,146 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package decryptstart
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stubDecrypter "decrypts" by uppercasing the ciphertext bytes, so tests can
+// assert on the result without any real crypto; failOn makes it error on a
+// specific input to exercise the strict/non-strict error paths.
+type stubDecrypter struct {
+	failOn string
+}
+
+func (d stubDecrypter) Decrypt(cipherText []byte) ([]byte, error) {
+	if d.failOn != "" && string(cipherText) == d.failOn {
+		return nil, errors.New("decrypt failed")
+	}
+
+	out := make([]byte, len(cipherText))
+	for i, b := range cipherText {
+		if b >= 'a' && b <= 'z' {
+			b -= 'a' - 'A'
+		}
+
+		out[i] = b
+	}
+
+	return out, nil
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestDecryptEnvironReplacesPrefixedValues(t *testing.T) {
+	environ := []string{
+		"PLAIN=unchanged",
+		"SECRET=kms:" + b64("hunter2"),
+		"OTHER_PREFIX=decrypt:" + b64("swordfish"),
+		"malformed-no-equals",
+	}
+
+	out, err := decryptEnviron(stubDecrypter{}, environ, Options{Prefixes: []string{"kms:", "decrypt:"}})
+	if err != nil {
+		t.Fatalf("decryptEnviron() error = %v", err)
+	}
+
+	want := []string{
+		"PLAIN=unchanged",
+		"SECRET=HUNTER2",
+		"OTHER_PREFIX=SWORDFISH",
+		"malformed-no-equals",
+	}
+
+	if len(out) != len(want) {
+		t.Fatalf("decryptEnviron() = %v, want %v", out, want)
+	}
+
+	for i := range want {
+		if out[i] != want[i] {
+			t.Errorf("out[%d] = %q, want %q", i, out[i], want[i])
+		}
+	}
+}
+
+func TestDecryptEnvironAtFilePrefix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ciphertext")
+
+	if err := os.WriteFile(path, []byte(b64("from-a-file")+"\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	environ := []string{"SECRET=kms:@" + path}
+
+	out, err := decryptEnviron(stubDecrypter{}, environ, Options{Prefixes: []string{"kms:"}})
+	if err != nil {
+		t.Fatalf("decryptEnviron() error = %v", err)
+	}
+
+	if want := "SECRET=FROM-A-FILE"; out[0] != want {
+		t.Errorf("out[0] = %q, want %q", out[0], want)
+	}
+}
+
+func TestDecryptEnvironNonStrictLeavesFailuresUntouched(t *testing.T) {
+	environ := []string{"SECRET=kms:" + b64("boom")}
+
+	out, err := decryptEnviron(stubDecrypter{failOn: "boom"}, environ, Options{Prefixes: []string{"kms:"}, Strict: false})
+	if err != nil {
+		t.Fatalf("decryptEnviron() error = %v, want nil in non-strict mode", err)
+	}
+
+	if want := environ[0]; out[0] != want {
+		t.Errorf("out[0] = %q, want unchanged %q", out[0], want)
+	}
+}
+
+func TestDecryptEnvironStrictAbortsOnFailure(t *testing.T) {
+	environ := []string{"SECRET=kms:" + b64("boom")}
+
+	_, err := decryptEnviron(stubDecrypter{failOn: "boom"}, environ, Options{Prefixes: []string{"kms:"}, Strict: true})
+	if err == nil {
+		t.Fatal("decryptEnviron() error = nil, want error in strict mode")
+	}
+}
+
+func TestMatchPrefix(t *testing.T) {
+	prefix, rest, ok := matchPrefix("kms:abc", []string{"kms:", "decrypt:"})
+	if !ok || prefix != "kms:" || rest != "abc" {
+		t.Errorf("matchPrefix() = (%q, %q, %v), want (%q, %q, true)", prefix, rest, ok, "kms:", "abc")
+	}
+
+	if _, _, ok := matchPrefix("plaintext", []string{"kms:", "decrypt:"}); ok {
+		t.Error("matchPrefix() ok = true for a value with no matching prefix")
+	}
+}
+
+func TestSplitEnv(t *testing.T) {
+	name, value, ok := splitEnv("FOO=bar=baz")
+	if !ok || name != "FOO" || value != "bar=baz" {
+		t.Errorf("splitEnv() = (%q, %q, %v), want (%q, %q, true)", name, value, ok, "FOO", "bar=baz")
+	}
+
+	if _, _, ok := splitEnv("no-equals-sign"); ok {
+		t.Error("splitEnv() ok = true for a value with no '='")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlcrypto lets database/sql callers store KMS-encrypted values
+// transparently, by wrapping an awskms.Cryptor in the database/sql/driver
+// Valuer/Scanner pair.
+package sqlcrypto
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+
+	"emperror.dev/errors"
+
+	"github.com/bank-vaults/bank-vaults/pkg/kv/awskms"
+)
+
+// Encrypted is a database/sql value that's transparently encrypted with a
+// Cryptor on Value() and decrypted on Scan(), so a column can hold
+// KMS-protected data without the application ever handling the ciphertext.
+type Encrypted struct {
+	Cryptor   awskms.Cryptor
+	Plaintext []byte
+}
+
+var (
+	_ driver.Valuer = Encrypted{}
+	_ sql.Scanner   = &Encrypted{}
+)
+
+// Value encrypts Plaintext and base64-encodes it for storage in a TEXT/
+// VARCHAR/BYTEA column.
+func (e Encrypted) Value() (driver.Value, error) {
+	cipherText, err := e.Cryptor.Encrypt(e.Plaintext)
+	if err != nil {
+		return nil, errors.WrapIf(err, "failed to encrypt value for database/sql")
+	}
+
+	return base64.StdEncoding.EncodeToString(cipherText), nil
+}
+
+// Scan base64-decodes and decrypts src into Plaintext.
+func (e *Encrypted) Scan(src interface{}) error {
+	var encoded string
+
+	switch v := src.(type) {
+	case nil:
+		e.Plaintext = nil
+
+		return nil
+	case string:
+		encoded = v
+	case []byte:
+		encoded = string(v)
+	default:
+		return errors.Errorf("unsupported type %T for sqlcrypto.Encrypted", src)
+	}
+
+	cipherText, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return errors.WrapIf(err, "failed to base64-decode encrypted column")
+	}
+
+	plainText, err := e.Cryptor.Decrypt(cipherText)
+	if err != nil {
+		return errors.WrapIf(err, "failed to decrypt value from database/sql")
+	}
+
+	e.Plaintext = plainText
+
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright © 2018 Banzai Cloud
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlcrypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// xorCryptor is a stub awskms.Cryptor that reversibly "encrypts" by XOR-ing
+// with a fixed byte, so tests can assert on ciphertext without real crypto.
+type xorCryptor struct {
+	failEncrypt bool
+	failDecrypt bool
+}
+
+func (c xorCryptor) xor(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, v := range b {
+		out[i] = v ^ 0xAA
+	}
+
+	return out
+}
+
+func (c xorCryptor) Encrypt(plainText []byte) ([]byte, error) {
+	if c.failEncrypt {
+		return nil, errors.New("encrypt failed")
+	}
+
+	return c.xor(plainText), nil
+}
+
+func (c xorCryptor) Decrypt(cipherText []byte) ([]byte, error) {
+	if c.failDecrypt {
+		return nil, errors.New("decrypt failed")
+	}
+
+	return c.xor(cipherText), nil
+}
+
+func TestEncryptedValueScanRoundTrip(t *testing.T) {
+	e := Encrypted{Cryptor: xorCryptor{}, Plaintext: []byte("secret value")}
+
+	dv, err := e.Value()
+	if err != nil {
+		t.Fatalf("Value() error = %v", err)
+	}
+
+	encoded, ok := dv.(string)
+	if !ok {
+		t.Fatalf("Value() returned %T, want string", dv)
+	}
+
+	var got Encrypted
+	got.Cryptor = xorCryptor{}
+
+	if err := got.Scan(encoded); err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+
+	if !bytes.Equal(got.Plaintext, e.Plaintext) {
+		t.Errorf("Scan() plaintext = %q, want %q", got.Plaintext, e.Plaintext)
+	}
+}
+
+func TestEncryptedScanAcceptsBytesAndNil(t *testing.T) {
+	e := Encrypted{Cryptor: xorCryptor{}, Plaintext: []byte("secret value")}
+
+	dv, err := e.Value()
+	if err != nil {
+		t.Fatalf("Value() error = %v", err)
+	}
+
+	var fromBytes Encrypted
+	fromBytes.Cryptor = xorCryptor{}
+
+	if err := fromBytes.Scan([]byte(dv.(string))); err != nil {
+		t.Fatalf("Scan([]byte) error = %v", err)
+	}
+
+	if !bytes.Equal(fromBytes.Plaintext, e.Plaintext) {
+		t.Errorf("Scan([]byte) plaintext = %q, want %q", fromBytes.Plaintext, e.Plaintext)
+	}
+
+	var fromNil Encrypted
+	fromNil.Cryptor = xorCryptor{}
+
+	if err := fromNil.Scan(nil); err != nil {
+		t.Fatalf("Scan(nil) error = %v", err)
+	}
+
+	if fromNil.Plaintext != nil {
+		t.Errorf("Scan(nil) plaintext = %q, want nil", fromNil.Plaintext)
+	}
+}
+
+func TestEncryptedScanRejectsUnsupportedType(t *testing.T) {
+	var e Encrypted
+	e.Cryptor = xorCryptor{}
+
+	if err := e.Scan(42); err == nil {
+		t.Fatal("Scan(42) error = nil, want error for an unsupported source type")
+	}
+}
+
+func TestEncryptedValuePropagatesEncryptError(t *testing.T) {
+	e := Encrypted{Cryptor: xorCryptor{failEncrypt: true}, Plaintext: []byte("x")}
+
+	if _, err := e.Value(); err == nil {
+		t.Fatal("Value() error = nil, want error when the Cryptor fails to encrypt")
+	}
+}
+
+func TestEncryptedScanPropagatesDecryptError(t *testing.T) {
+	e := Encrypted{Cryptor: xorCryptor{}, Plaintext: []byte("x")}
+
+	dv, err := e.Value()
+	if err != nil {
+		t.Fatalf("Value() error = %v", err)
+	}
+
+	var got Encrypted
+	got.Cryptor = xorCryptor{failDecrypt: true}
+
+	if err := got.Scan(dv); err == nil {
+		t.Fatal("Scan() error = nil, want error when the Cryptor fails to decrypt")
+	}
+}
+
+func TestEncryptedScanRejectsInvalidBase64(t *testing.T) {
+	var e Encrypted
+	e.Cryptor = xorCryptor{}
+
+	if err := e.Scan("not valid base64!!"); err == nil {
+		t.Fatal("Scan() error = nil, want error for invalid base64")
+	}
+}